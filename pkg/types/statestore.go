@@ -0,0 +1,207 @@
+// Pluggable shared-state backend for running multiple flowscheduler
+// instances against the same cluster (à la Ballista's multi-scheduler
+// design). ResourceMap/JobMap/TaskMap keep their existing in-process,
+// mutex-guarded API for single-scheduler use; StateStore is the
+// lower-level key/value primitive a multi-scheduler deployment layers on
+// top of to keep those maps consistent across instances.
+
+package types
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrCASMismatch is returned by CompareAndSwap when the stored value does
+// not match the expected one.
+var ErrCASMismatch = errors.New("types: compare-and-swap value mismatch")
+
+// StateStoreKey namespaces a StateStore entry. Prefix groups related keys
+// (e.g. "resource-topology/", "job-queue/") so a single watch can cover a
+// whole class of state.
+type StateStoreKey struct {
+	Prefix string
+	Name   string
+}
+
+// StateStoreEvent is delivered on a Watch channel when a key under the
+// watched prefix changes.
+type StateStoreEvent struct {
+	Key     StateStoreKey
+	Value   []byte
+	Deleted bool
+}
+
+// StateStore is the shared-state primitive a multi-scheduler deployment is
+// built on: every flowscheduler instance reads/writes the same keys
+// through an implementation of this interface instead of holding the only
+// copy of the state in process memory.
+type StateStore interface {
+	// Get returns the value for k, or ok == false if it is not present.
+	Get(k StateStoreKey) (value []byte, ok bool, err error)
+	// Put unconditionally sets the value for k.
+	Put(k StateStoreKey, value []byte) error
+	// Delete removes k. It is not an error for k to already be absent.
+	Delete(k StateStoreKey) error
+	// CompareAndSwap sets k to newValue only if its current value equals
+	// oldValue (a missing key matches a nil oldValue). It returns
+	// ErrCASMismatch if the current value didn't match.
+	CompareAndSwap(k StateStoreKey, oldValue, newValue []byte) error
+	// Watch streams StateStoreEvents for every key under prefix until
+	// stopCh is closed.
+	Watch(prefix string, stopCh <-chan struct{}) (<-chan StateStoreEvent, error)
+
+	// NewSession creates a lease with the given TTL. Keys written with
+	// PutWithSession are released (deleted) if the session isn't renewed
+	// within the TTL, which is what lets another scheduler take over a
+	// leader key after a crash. Close ends the session and releases its keys
+	// immediately.
+	NewSession(ttlSeconds int64) (Session, error)
+	// PutWithSession behaves like CompareAndSwap, but newValue is only kept
+	// alive for as long as sess is.
+	PutWithSession(k StateStoreKey, oldValue, newValue []byte, sess Session) error
+}
+
+// Session is a StateStore-implementation-specific lease handle, as created
+// by StateStore.NewSession.
+type Session interface {
+	// ID identifies the session to the backing store (e.g. an etcd lease ID).
+	ID() string
+	// Close ends the session, releasing any keys written with it.
+	Close() error
+}
+
+// memStateStore is the default, in-memory StateStore implementation: a
+// single flowscheduler instance talking to itself. It is not safe for use
+// across OS processes, only across goroutines within one.
+type memStateStore struct {
+	mu         sync.RWMutex
+	values     map[StateStoreKey][]byte
+	watchers   map[string][]chan StateStoreEvent
+	sessionSeq int
+}
+
+// NewMemStateStore returns a StateStore backed by an in-process map. It is
+// the default used when a scheduler isn't configured for HA.
+func NewMemStateStore() StateStore {
+	return &memStateStore{
+		values:   make(map[StateStoreKey][]byte),
+		watchers: make(map[string][]chan StateStoreEvent),
+	}
+}
+
+func (m *memStateStore) Get(k StateStoreKey) ([]byte, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.values[k]
+	return v, ok, nil
+}
+
+func (m *memStateStore) Put(k StateStoreKey, value []byte) error {
+	m.mu.Lock()
+	m.values[k] = value
+	m.mu.Unlock()
+	m.notify(k, value, false)
+	return nil
+}
+
+func (m *memStateStore) Delete(k StateStoreKey) error {
+	m.mu.Lock()
+	delete(m.values, k)
+	m.mu.Unlock()
+	m.notify(k, nil, true)
+	return nil
+}
+
+func (m *memStateStore) CompareAndSwap(k StateStoreKey, oldValue, newValue []byte) error {
+	m.mu.Lock()
+	cur, ok := m.values[k]
+	if (ok && string(cur) != string(oldValue)) || (!ok && oldValue != nil) {
+		m.mu.Unlock()
+		return ErrCASMismatch
+	}
+	m.values[k] = newValue
+	m.mu.Unlock()
+	m.notify(k, newValue, false)
+	return nil
+}
+
+// memSession is memStateStore's Session: since there is only ever one
+// process sharing a memStateStore, a session never actually expires on its
+// own, but Close still releases its keys so leader hand-off can be tested
+// without etcd.
+type memSession struct {
+	store *memStateStore
+	id    string
+	keys  map[StateStoreKey]struct{}
+}
+
+func (s *memSession) ID() string { return s.id }
+
+func (s *memSession) Close() error {
+	s.store.mu.Lock()
+	for k := range s.keys {
+		delete(s.store.values, k)
+	}
+	s.store.mu.Unlock()
+	for k := range s.keys {
+		s.store.notify(k, nil, true)
+	}
+	return nil
+}
+
+func (m *memStateStore) NewSession(ttlSeconds int64) (Session, error) {
+	m.mu.Lock()
+	m.sessionSeq++
+	id := string(rune('a' + m.sessionSeq%26))
+	m.mu.Unlock()
+	return &memSession{store: m, id: id, keys: make(map[StateStoreKey]struct{})}, nil
+}
+
+func (m *memStateStore) PutWithSession(k StateStoreKey, oldValue, newValue []byte, sess Session) error {
+	if err := m.CompareAndSwap(k, oldValue, newValue); err != nil {
+		return err
+	}
+	if ms, ok := sess.(*memSession); ok {
+		ms.keys[k] = struct{}{}
+	}
+	return nil
+}
+
+func (m *memStateStore) Watch(prefix string, stopCh <-chan struct{}) (<-chan StateStoreEvent, error) {
+	ch := make(chan StateStoreEvent, 16)
+	m.mu.Lock()
+	m.watchers[prefix] = append(m.watchers[prefix], ch)
+	m.mu.Unlock()
+	go func() {
+		<-stopCh
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		watchers := m.watchers[prefix]
+		for i, w := range watchers {
+			if w == ch {
+				m.watchers[prefix] = append(watchers[:i], watchers[i+1:]...)
+				break
+			}
+		}
+		close(ch)
+	}()
+	return ch, nil
+}
+
+func (m *memStateStore) notify(k StateStoreKey, value []byte, deleted bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for prefix, watchers := range m.watchers {
+		if k.Prefix != prefix {
+			continue
+		}
+		for _, w := range watchers {
+			select {
+			case w <- StateStoreEvent{Key: k, Value: value, Deleted: deleted}:
+			default:
+				// Slow watcher; drop rather than block Put/CompareAndSwap.
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package types
+
+import (
+	"errors"
+	"strconv"
+
+	"golang.org/x/net/context"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+)
+
+// etcdSession wraps a concurrency.Session, the idiomatic etcd v3 way to tie
+// a lease to a keep-alive goroutine.
+type etcdSession struct {
+	s *concurrency.Session
+}
+
+func (e *etcdSession) ID() string   { return strconv.FormatInt(int64(e.s.Lease()), 10) }
+func (e *etcdSession) Close() error { return e.s.Close() }
+
+var errNotEtcdSession = errors.New("types: session was not created by an etcdStateStore")
+
+// etcdStateStore is the StateStore implementation multiple flowscheduler
+// processes share when running in HA mode: every Get/Put/CompareAndSwap
+// goes to etcd instead of an in-process map, so all instances observe the
+// same state.
+type etcdStateStore struct {
+	client *etcd.Client
+}
+
+// NewEtcdStateStore returns a StateStore backed by the given etcd client.
+// The caller owns the client's lifecycle (Close it when done).
+func NewEtcdStateStore(client *etcd.Client) StateStore {
+	return &etcdStateStore{client: client}
+}
+
+func (e *etcdStateStore) key(k StateStoreKey) string {
+	return k.Prefix + k.Name
+}
+
+func (e *etcdStateStore) Get(k StateStoreKey) ([]byte, bool, error) {
+	resp, err := e.client.Get(context.Background(), e.key(k))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, false, nil
+	}
+	return resp.Kvs[0].Value, true, nil
+}
+
+func (e *etcdStateStore) Put(k StateStoreKey, value []byte) error {
+	_, err := e.client.Put(context.Background(), e.key(k), string(value))
+	return err
+}
+
+func (e *etcdStateStore) Delete(k StateStoreKey) error {
+	_, err := e.client.Delete(context.Background(), e.key(k))
+	return err
+}
+
+// CompareAndSwap implements the store-wide CAS contract on top of etcd's
+// transaction API: the write only commits if the key's current value
+// (or absence, when oldValue is nil) still matches what the caller expects.
+func (e *etcdStateStore) CompareAndSwap(k StateStoreKey, oldValue, newValue []byte) error {
+	key := e.key(k)
+	var cmp etcd.Cmp
+	if oldValue == nil {
+		cmp = etcd.Compare(etcd.CreateRevision(key), "=", 0)
+	} else {
+		cmp = etcd.Compare(etcd.Value(key), "=", string(oldValue))
+	}
+	resp, err := e.client.Txn(context.Background()).
+		If(cmp).
+		Then(etcd.OpPut(key, string(newValue))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return ErrCASMismatch
+	}
+	return nil
+}
+
+// NewSession starts an etcd lease with the given TTL and keeps it alive in
+// the background for as long as the returned Session is open.
+func (e *etcdStateStore) NewSession(ttlSeconds int64) (Session, error) {
+	s, err := concurrency.NewSession(e.client, concurrency.WithTTL(int(ttlSeconds)))
+	if err != nil {
+		return nil, err
+	}
+	return &etcdSession{s: s}, nil
+}
+
+// PutWithSession is CompareAndSwap plus attaching sess's lease to the new
+// value, so it disappears if sess isn't renewed in time.
+func (e *etcdStateStore) PutWithSession(k StateStoreKey, oldValue, newValue []byte, sess Session) error {
+	es, ok := sess.(*etcdSession)
+	if !ok {
+		return errNotEtcdSession
+	}
+	key := e.key(k)
+	var cmp etcd.Cmp
+	if oldValue == nil {
+		cmp = etcd.Compare(etcd.CreateRevision(key), "=", 0)
+	} else {
+		cmp = etcd.Compare(etcd.Value(key), "=", string(oldValue))
+	}
+	resp, err := e.client.Txn(context.Background()).
+		If(cmp).
+		Then(etcd.OpPut(key, string(newValue), etcd.WithLease(es.s.Lease()))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return ErrCASMismatch
+	}
+	return nil
+}
+
+// Watch streams changes to every key under prefix until stopCh is closed.
+// The returned channel is closed when the watch ends.
+func (e *etcdStateStore) Watch(prefix string, stopCh <-chan struct{}) (<-chan StateStoreEvent, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan StateStoreEvent, 16)
+	wch := e.client.Watch(ctx, prefix, etcd.WithPrefix())
+
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	go func() {
+		defer close(out)
+		for resp := range wch {
+			for _, ev := range resp.Events {
+				out <- StateStoreEvent{
+					Key:     StateStoreKey{Prefix: prefix, Name: string(ev.Kv.Key[len(prefix):])},
+					Value:   ev.Kv.Value,
+					Deleted: ev.Type == etcd.EventTypeDelete,
+				}
+			}
+		}
+	}()
+	return out, nil
+}
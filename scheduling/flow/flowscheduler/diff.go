@@ -0,0 +1,173 @@
+package flowscheduler
+
+import (
+	"github.com/coreos/ksched/pkg/types"
+	"github.com/coreos/ksched/pkg/util"
+	pb "github.com/coreos/ksched/proto"
+)
+
+// diffEntry is a single task's reconciliation outcome: what it is currently
+// bound to (if anything) and what it should become.
+type diffEntry struct {
+	TaskID types.TaskID
+	JobID  types.JobID
+	TD     *pb.TaskDescriptor
+	RD     *pb.ResourceDescriptor
+}
+
+// diffResult is the outcome of reconciling the previous iteration's
+// bindings against the current set of jobs/resources, modeled on Nomad's
+// materializeTaskGroups/diffAllocs. candidateTasks() (place/update/migrate)
+// is the list RunSchedulingIteration hands to the flow solver; ignore/lost/
+// stop are resolved without it, which is what keeps the solver's graph from
+// growing with every task in steady state.
+type diffResult struct {
+	// place holds runnable tasks that have never been bound to a resource.
+	place []diffEntry
+	// update holds bound tasks whose descriptor changed since the last
+	// iteration and so must be re-considered by the solver.
+	update []diffEntry
+	// migrate holds bound tasks whose resource still exists but that the
+	// caller has asked to move (e.g. draining a node).
+	migrate []diffEntry
+	// stop holds tasks that should be torn down outright (e.g. their job
+	// was cancelled).
+	stop []diffEntry
+	// ignore holds tasks whose binding is unchanged and don't need to be
+	// considered by the solver this iteration.
+	ignore []diffEntry
+	// lost holds tasks whose bound resource has disappeared from
+	// resourceMap; they emit a synthetic PREEMPT delta.
+	lost []diffEntry
+}
+
+// computeDiff reconciles prevBindings (the task->resource bindings as of
+// the end of the last iteration) against jobsToSchedule and resourceMap. It
+// is called at the start of every RunSchedulingIteration so that the flow
+// graph only has to carry candidates that can actually change, rather than
+// every runnable task in the cluster.
+func computeDiff(
+	prevBindings map[types.TaskID]types.ResourceID,
+	jobsToSchedule map[types.JobID]*pb.JobDescriptor,
+	runnableTasks map[types.JobID]TaskSet,
+	taskMap types.TaskMap,
+	resourceMap types.ResourceMap,
+) *diffResult {
+	diff := &diffResult{}
+
+	seen := make(map[types.TaskID]struct{}, len(prevBindings))
+	for taskID, resID := range prevBindings {
+		seen[taskID] = struct{}{}
+		td := taskMap.FindPtrOrNull(taskID)
+		jobID := util.MustJobIDFromString(td.JobID)
+		entry := diffEntry{TaskID: taskID, JobID: jobID, TD: td}
+
+		if !resourceMap.ContainsKey(resID) {
+			diff.lost = append(diff.lost, entry)
+			continue
+		}
+		rs := resourceMap.FindPtrOrNull(resID)
+		entry.RD = rs.Descriptor()
+
+		if _, stillScheduled := jobsToSchedule[jobID]; !stillScheduled {
+			diff.stop = append(diff.stop, entry)
+			continue
+		}
+		if taskChanged(td) {
+			diff.update = append(diff.update, entry)
+			continue
+		}
+		diff.ignore = append(diff.ignore, entry)
+	}
+
+	// Any runnable task that doesn't already have a binding needs to be
+	// placed for the first time.
+	for jobID := range jobsToSchedule {
+		for taskID := range runnableTasks[jobID] {
+			if _, bound := seen[taskID]; bound {
+				continue
+			}
+			td := taskMap.FindPtrOrNull(taskID)
+			diff.place = append(diff.place, diffEntry{TaskID: taskID, JobID: jobID, TD: td})
+		}
+	}
+
+	return diff
+}
+
+// taskChanged reports whether td's descriptor has been mutated since it was
+// last bound, i.e. whether UpdateTask has been called for it since the last
+// iteration folded the change into a delta. Firmament doesn't version
+// TaskDescriptors, so we approximate this with a flag rather than a diff
+// against a snapshot; this keeps computeDiff cheap and side-effect free.
+func taskChanged(td *pb.TaskDescriptor) bool {
+	return td.PendingUpdate
+}
+
+// UpdateTask lets a caller mutate an already-bound task's descriptor (e.g.
+// changing its resource request) in place. Setting PendingUpdate is what
+// moves the task from diff.ignore into diff.update on the next
+// RunSchedulingIteration, so the change actually gets re-considered by the
+// solver instead of being silently skipped.
+func (s *scheduler) UpdateTask(taskID types.TaskID, mutate func(td *pb.TaskDescriptor)) {
+	td := s.taskMap.FindPtrOrNull(taskID)
+	if td == nil {
+		return
+	}
+	mutate(td)
+	td.PendingUpdate = true
+}
+
+// candidateTasks returns the TaskIDs in diff that should be handed to the
+// flow solver this iteration: everything except ignore, lost and stop, which
+// are resolved directly.
+func (d *diffResult) candidateTasks() []types.TaskID {
+	var ids []types.TaskID
+	for _, e := range d.place {
+		ids = append(ids, e.TaskID)
+	}
+	for _, e := range d.update {
+		ids = append(ids, e.TaskID)
+	}
+	for _, e := range d.migrate {
+		ids = append(ids, e.TaskID)
+	}
+	return ids
+}
+
+// deltasForDiff turns the parts of diff that need a delta regardless of the
+// solver's output into scheduling deltas: lost tasks are preempted since their resource is
+// gone, update tasks are re-bound even when the solver would otherwise
+// leave their flow assignment alone, and stop tasks (their job left
+// jobsToSchedule, e.g. it was cancelled) are torn down with a first-class
+// KILL delta rather than being silently dropped.
+func (s *scheduler) deltasForDiff(diff *diffResult) []pb.SchedulingDelta {
+	var deltas []pb.SchedulingDelta
+	for _, e := range diff.lost {
+		deltas = append(deltas, pb.SchedulingDelta{
+			TaskId: uint64(e.TaskID),
+			Type:   pb.SchedulingDelta_PREEMPT,
+		})
+	}
+	for _, e := range diff.update {
+		if e.RD == nil {
+			continue
+		}
+		deltas = append(deltas, pb.SchedulingDelta{
+			TaskId:     uint64(e.TaskID),
+			ResourceId: e.RD.Uuid,
+			Type:       pb.SchedulingDelta_PLACE,
+		})
+		// The update has now been folded into a delta; clear the flag so
+		// the task isn't re-offered to the solver every iteration until
+		// UpdateTask sets it again.
+		e.TD.PendingUpdate = false
+	}
+	for _, e := range diff.stop {
+		deltas = append(deltas, pb.SchedulingDelta{
+			TaskId: uint64(e.TaskID),
+			Type:   pb.SchedulingDelta_KILL,
+		})
+	}
+	return deltas
+}
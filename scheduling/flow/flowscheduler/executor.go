@@ -0,0 +1,122 @@
+package flowscheduler
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/coreos/ksched/pkg/types"
+	pb "github.com/coreos/ksched/proto"
+)
+
+// TaskHandle identifies a task launch with a given Executor, so later
+// Kill/Migrate/Status calls can address it without re-deriving it from the
+// TaskDescriptor.
+type TaskHandle string
+
+// TaskStatus is an Executor's view of a task, independent of the
+// scheduler's own TaskStateMachine bookkeeping.
+type TaskStatus int
+
+const (
+	TaskStatusUnknown TaskStatus = iota
+	TaskStatusRunning
+	TaskStatusFinished
+	TaskStatusLost
+)
+
+// ExecutorEvent is pushed on an Executor's Events channel whenever a task's
+// status changes outside of a call the scheduler itself made, e.g. the
+// remote agent running it died or the task exited on its own.
+type ExecutorEvent struct {
+	TaskID types.TaskID
+	Status TaskStatus
+	Err    error
+}
+
+// Executor drives the actual PLACE/PREEMPT/MIGRATE side effects that
+// HandleTaskPlacement/HandleTaskEviction/HandleTaskMigration used to be
+// no-ops for. The scheduler holds exactly one; FakeExecutor is used in
+// tests, RemoteExecutor talks to an out-of-process agent through whatever
+// RemoteExecutorClient it is given.
+type Executor interface {
+	Launch(td *pb.TaskDescriptor, rd *pb.ResourceDescriptor) (TaskHandle, error)
+	Kill(taskID types.TaskID) error
+	Migrate(taskID types.TaskID, dstRD *pb.ResourceDescriptor) error
+	Status(taskID types.TaskID) TaskStatus
+	Events() <-chan ExecutorEvent
+}
+
+// ErrTaskNotLaunched is returned by Kill/Migrate for a task the executor
+// never launched (or has already forgotten about); Status reports such a
+// task as TaskStatusUnknown.
+var ErrTaskNotLaunched = errors.New("flowscheduler: task was not launched by this executor")
+
+// FakeExecutor is an in-process Executor for tests: Launch/Kill/Migrate
+// just update its own bookkeeping, and it never emits unsolicited
+// ExecutorEvents unless the test calls Inject.
+type FakeExecutor struct {
+	mu      sync.Mutex
+	handles map[types.TaskID]TaskHandle
+	status  map[types.TaskID]TaskStatus
+	events  chan ExecutorEvent
+	seq     int
+}
+
+// NewFakeExecutor returns a ready-to-use FakeExecutor.
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{
+		handles: make(map[types.TaskID]TaskHandle),
+		status:  make(map[types.TaskID]TaskStatus),
+		events:  make(chan ExecutorEvent, 64),
+	}
+}
+
+func (f *FakeExecutor) Launch(td *pb.TaskDescriptor, rd *pb.ResourceDescriptor) (TaskHandle, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	taskID := types.TaskID(td.Uid)
+	f.seq++
+	handle := TaskHandle(fmt.Sprintf("fake/%d", f.seq))
+	f.handles[taskID] = handle
+	f.status[taskID] = TaskStatusRunning
+	return handle, nil
+}
+
+func (f *FakeExecutor) Kill(taskID types.TaskID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.handles[taskID]; !ok {
+		return ErrTaskNotLaunched
+	}
+	f.status[taskID] = TaskStatusFinished
+	return nil
+}
+
+func (f *FakeExecutor) Migrate(taskID types.TaskID, dstRD *pb.ResourceDescriptor) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.handles[taskID]; !ok {
+		return ErrTaskNotLaunched
+	}
+	return nil
+}
+
+func (f *FakeExecutor) Status(taskID types.TaskID) TaskStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status[taskID]
+}
+
+func (f *FakeExecutor) Events() <-chan ExecutorEvent {
+	return f.events
+}
+
+// Inject lets a test simulate an out-of-band status change, e.g. a task
+// finishing or its resource being lost, without going through Kill.
+func (f *FakeExecutor) Inject(ev ExecutorEvent) {
+	f.mu.Lock()
+	f.status[ev.TaskID] = ev.Status
+	f.mu.Unlock()
+	f.events <- ev
+}
@@ -0,0 +1,88 @@
+package flowscheduler
+
+import (
+	"log"
+
+	"github.com/coreos/ksched/pkg/types"
+	pb "github.com/coreos/ksched/proto"
+)
+
+// SetExecutor installs the Executor this scheduler drives PLACE/PREEMPT/
+// MIGRATE/KILL deltas through, and starts the background goroutine that
+// acks its ExecutorEvents.
+func (s *scheduler) SetExecutor(executor Executor) {
+	s.executor = executor
+	s.taskHandles = make(map[types.TaskID]TaskHandle)
+	go s.ackExecutorEvents()
+}
+
+// ackExecutorEvents drains the executor's event stream for as long as it
+// stays open, driving the task state machine and, for lost tasks on
+// resources that are still alive, filing a synthetic PLACE delta so the
+// task gets relaunched on the next iteration rather than staying dead.
+func (s *scheduler) ackExecutorEvents() {
+	for ev := range s.executor.Events() {
+		switch ev.Status {
+		case TaskStatusFinished:
+			s.ackTaskFinished(ev.TaskID)
+		case TaskStatusLost:
+			s.ackTaskLost(ev.TaskID)
+		}
+	}
+}
+
+func (s *scheduler) ackTaskFinished(taskID types.TaskID) {
+	td := s.taskMap.FindPtrOrNull(taskID)
+	if td == nil {
+		log.Printf("flowscheduler: executor event for unknown task %v", taskID)
+		return
+	}
+	if _, err := s.taskStateMachine.Drive(taskID, EventCompleted); err != nil {
+		log.Printf("flowscheduler: task %v: %v", taskID, err)
+		return
+	}
+	s.taskHandlesMu.Lock()
+	delete(s.taskHandles, taskID)
+	s.taskHandlesMu.Unlock()
+	td.State = pb.TaskDescriptor_Completed
+	s.tasksFinished++
+}
+
+// ackTaskLost handles an executor-reported loss: if the task's resource is
+// still registered, the task just died (e.g. crashed or was OOM-killed),
+// so it is re-queued with a synthetic PLACE delta rather than waiting for
+// the next full diff/solve cycle to notice.
+func (s *scheduler) ackTaskLost(taskID types.TaskID) {
+	td := s.taskMap.FindPtrOrNull(taskID)
+	if td == nil {
+		log.Printf("flowscheduler: executor event for unknown task %v", taskID)
+		return
+	}
+	s.taskBindingsMu.Lock()
+	resID, bound := s.taskBindings[taskID]
+	s.taskBindingsMu.Unlock()
+	s.taskHandlesMu.Lock()
+	delete(s.taskHandles, taskID)
+	s.taskHandlesMu.Unlock()
+	relaunch := bound && s.resourceMap.ContainsKey(resID)
+	// A task that is about to be re-placed goes to Preempted, the state that
+	// accepts a re-Assign; Failed has no outgoing transitions.
+	event := EventFailed
+	if relaunch && s.taskStateMachine.alpha(taskID, EventPreempted) {
+		event = EventPreempted
+	}
+	if _, err := s.taskStateMachine.Drive(taskID, event); err != nil {
+		log.Printf("flowscheduler: task %v: %v", taskID, err)
+	}
+	td.State = pb.TaskDescriptor_Failed
+
+	if !relaunch {
+		return
+	}
+	rs := s.resourceMap.FindPtrOrNull(resID)
+	s.retryQueue = append(s.retryQueue, retryableDelta{delta: pb.SchedulingDelta{
+		TaskId:     uint64(taskID),
+		ResourceId: rs.Descriptor().Uuid,
+		Type:       pb.SchedulingDelta_PLACE,
+	}})
+}
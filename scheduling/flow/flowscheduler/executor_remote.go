@@ -0,0 +1,56 @@
+package flowscheduler
+
+import (
+	"github.com/coreos/ksched/pkg/types"
+	pb "github.com/coreos/ksched/proto"
+)
+
+// RemoteExecutorClient is the out-of-process agent API RemoteExecutor
+// drives. It is deliberately expressed in the same terms as the Executor
+// interface rather than as a generated gRPC client, since this tree has no
+// executor proto/codegen: whatever RPC framework a deployment wires up
+// (gRPC, Thrift, a REST shim) implements this interface directly instead of
+// RemoteExecutor depending on any particular one.
+type RemoteExecutorClient interface {
+	Launch(td *pb.TaskDescriptor, rd *pb.ResourceDescriptor) (TaskHandle, error)
+	Kill(taskID types.TaskID) error
+	Migrate(taskID types.TaskID, dstRD *pb.ResourceDescriptor) error
+	Status(taskID types.TaskID) TaskStatus
+	// Events streams unsolicited status changes (the remote agent died, the
+	// task exited on its own, etc). It is closed when the underlying
+	// connection to the agent ends.
+	Events() <-chan ExecutorEvent
+}
+
+// RemoteExecutor is the Executor implementation for a task launched on an
+// out-of-process agent, as opposed to FakeExecutor's in-process bookkeeping.
+// It is a thin pass-through to client: all the actual RPC plumbing lives on
+// whatever RemoteExecutorClient implementation the caller supplies.
+type RemoteExecutor struct {
+	client RemoteExecutorClient
+}
+
+// NewRemoteExecutor wraps an already-connected RemoteExecutorClient.
+func NewRemoteExecutor(client RemoteExecutorClient) *RemoteExecutor {
+	return &RemoteExecutor{client: client}
+}
+
+func (r *RemoteExecutor) Launch(td *pb.TaskDescriptor, rd *pb.ResourceDescriptor) (TaskHandle, error) {
+	return r.client.Launch(td, rd)
+}
+
+func (r *RemoteExecutor) Kill(taskID types.TaskID) error {
+	return r.client.Kill(taskID)
+}
+
+func (r *RemoteExecutor) Migrate(taskID types.TaskID, dstRD *pb.ResourceDescriptor) error {
+	return r.client.Migrate(taskID, dstRD)
+}
+
+func (r *RemoteExecutor) Status(taskID types.TaskID) TaskStatus {
+	return r.client.Status(taskID)
+}
+
+func (r *RemoteExecutor) Events() <-chan ExecutorEvent {
+	return r.client.Events()
+}
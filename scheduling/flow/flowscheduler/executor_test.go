@@ -0,0 +1,68 @@
+package flowscheduler
+
+import (
+	"testing"
+
+	"github.com/coreos/ksched/pkg/types"
+	pb "github.com/coreos/ksched/proto"
+)
+
+func TestFakeExecutorLaunchKillMigrate(t *testing.T) {
+	f := NewFakeExecutor()
+	td := &pb.TaskDescriptor{Uid: 1}
+	rd := &pb.ResourceDescriptor{Uuid: "res-1"}
+
+	handle, err := f.Launch(td, rd)
+	if err != nil {
+		t.Fatalf("Launch returned unexpected error: %v", err)
+	}
+	if handle == "" {
+		t.Fatal("Launch returned an empty TaskHandle")
+	}
+	if got := f.Status(types.TaskID(td.Uid)); got != TaskStatusRunning {
+		t.Fatalf("Status() = %v, want %v", got, TaskStatusRunning)
+	}
+
+	if err := f.Migrate(types.TaskID(td.Uid), &pb.ResourceDescriptor{Uuid: "res-2"}); err != nil {
+		t.Fatalf("Migrate returned unexpected error: %v", err)
+	}
+
+	if err := f.Kill(types.TaskID(td.Uid)); err != nil {
+		t.Fatalf("Kill returned unexpected error: %v", err)
+	}
+	if got := f.Status(types.TaskID(td.Uid)); got != TaskStatusFinished {
+		t.Fatalf("Status() after Kill = %v, want %v", got, TaskStatusFinished)
+	}
+}
+
+func TestFakeExecutorUnlaunchedTask(t *testing.T) {
+	f := NewFakeExecutor()
+	taskID := types.TaskID(99)
+
+	if err := f.Kill(taskID); err != ErrTaskNotLaunched {
+		t.Fatalf("Kill(unlaunched) = %v, want %v", err, ErrTaskNotLaunched)
+	}
+	if err := f.Migrate(taskID, &pb.ResourceDescriptor{Uuid: "res-1"}); err != ErrTaskNotLaunched {
+		t.Fatalf("Migrate(unlaunched) = %v, want %v", err, ErrTaskNotLaunched)
+	}
+}
+
+func TestFakeExecutorInject(t *testing.T) {
+	f := NewFakeExecutor()
+	taskID := types.TaskID(7)
+	ev := ExecutorEvent{TaskID: taskID, Status: TaskStatusLost}
+
+	f.Inject(ev)
+
+	if got := f.Status(taskID); got != TaskStatusLost {
+		t.Fatalf("Status() after Inject = %v, want %v", got, TaskStatusLost)
+	}
+	select {
+	case got := <-f.Events():
+		if got != ev {
+			t.Fatalf("Events() delivered %+v, want %+v", got, ev)
+		}
+	default:
+		t.Fatal("Events() had nothing queued after Inject")
+	}
+}
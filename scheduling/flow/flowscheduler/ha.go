@@ -0,0 +1,242 @@
+package flowscheduler
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+
+	"github.com/coreos/ksched/pkg/types"
+	"github.com/coreos/ksched/pkg/util"
+	pb "github.com/coreos/ksched/proto"
+)
+
+const (
+	// leaderElectionKeyPrefix namespaces the single key every HA scheduler
+	// instance campaigns for leadership on.
+	leaderElectionKeyPrefix = "leader-election/"
+	leaderElectionKeyName   = "flowscheduler"
+	// jobQueueKeyPrefix namespaces jobs submitted through AddJob so that
+	// non-leader instances can still accept them and have the leader pick
+	// them up on its next solve.
+	jobQueueKeyPrefix = "job-queue/"
+	// resourceTopologyKeyPrefix namespaces resource-topology change
+	// notifications; every live scheduler watches it regardless of
+	// leadership so resourceRoots stays in sync everywhere.
+	resourceTopologyKeyPrefix = "resource-topology/"
+
+	leaderSessionTTLSeconds = 10
+)
+
+// haState holds everything a scheduler needs to run as one of several
+// cooperating instances sharing a cluster via a common types.StateStore,
+// as opposed to being the only instance (the zero value of haState, i.e.
+// stateStore == nil, means HA is off and the scheduler always solves).
+type haState struct {
+	stateStore  types.StateStore
+	schedulerID string
+	session     types.Session
+	// isLeader is 0/1 rather than bool: campaignLoop writes it from its own
+	// goroutine while IsLeader() (called from RunSchedulingIteration) reads
+	// it from the scheduling-iteration goroutine, so it needs atomic access
+	// rather than a plain bool.
+	isLeader int32
+	stopCh   chan struct{}
+}
+
+// EnableHA switches the scheduler into multi-instance mode: only the
+// elected leader runs the min-cost-flow solve step each iteration, while
+// every instance (leader or not) keeps accepting AddJob/RegisterResource
+// and stays current on the resource topology via stateStore watches.
+func (s *scheduler) EnableHA(stateStore types.StateStore, schedulerID string) error {
+	sess, err := stateStore.NewSession(leaderSessionTTLSeconds)
+	if err != nil {
+		return err
+	}
+	s.ha = &haState{
+		stateStore:  stateStore,
+		schedulerID: schedulerID,
+		session:     sess,
+		stopCh:      make(chan struct{}),
+	}
+	go s.campaignLoop()
+	go s.watchResourceTopology()
+	go s.watchJobQueue()
+	return nil
+}
+
+// IsLeader reports whether this instance currently owns the solve step.
+// A scheduler that was never put into HA mode is always its own leader.
+func (s *scheduler) IsLeader() bool {
+	return s.ha == nil || atomic.LoadInt32(&s.ha.isLeader) == 1
+}
+
+// campaignLoop repeatedly tries to become leader by CAS-ing the shared
+// leader key to this instance's ID under its session's lease, so that if
+// this instance dies mid-iteration the key expires with the lease and
+// another instance can take over rather than waiting on a manual failover.
+func (s *scheduler) campaignLoop() {
+	key := types.StateStoreKey{Prefix: leaderElectionKeyPrefix, Name: leaderElectionKeyName}
+	for {
+		select {
+		case <-s.ha.stopCh:
+			return
+		default:
+		}
+
+		err := s.ha.stateStore.PutWithSession(key, nil, []byte(s.ha.schedulerID), s.ha.session)
+		if err == nil {
+			atomic.StoreInt32(&s.ha.isLeader, 1)
+		} else {
+			atomic.StoreInt32(&s.ha.isLeader, 0)
+		}
+
+		events, err := s.ha.stateStore.Watch(leaderElectionKeyPrefix, s.ha.stopCh)
+		if err != nil {
+			log.Printf("flowscheduler: leader watch error: %v", err)
+			continue
+		}
+		for ev := range events {
+			if ev.Deleted {
+				break
+			}
+		}
+		atomic.StoreInt32(&s.ha.isLeader, 0)
+	}
+}
+
+// watchResourceTopology rebuilds the resource this instance learns about
+// from the event payload itself (a marshaled ResourceTopologyNodeDescriptor
+// published by whichever instance ran RegisterResource), rather than just
+// re-touching roots this instance already happened to know about. Without
+// this, a resource registered on another instance would never show up in
+// this instance's resourceRoots/gm at all.
+func (s *scheduler) watchResourceTopology() {
+	events, err := s.ha.stateStore.Watch(resourceTopologyKeyPrefix, s.ha.stopCh)
+	if err != nil {
+		log.Printf("flowscheduler: resource-topology watch error: %v", err)
+		return
+	}
+	for ev := range events {
+		if ev.Deleted {
+			continue
+		}
+		var rtnd pb.ResourceTopologyNodeDescriptor
+		if err := json.Unmarshal(ev.Value, &rtnd); err != nil {
+			log.Printf("flowscheduler: bad resource-topology event for %s: %v", ev.Key.Name, err)
+			continue
+		}
+
+		s.resourceRootsMu.Lock()
+		alreadyKnown := false
+		for known := range s.resourceRoots {
+			if known.ResourceDesc.Uuid == rtnd.ResourceDesc.Uuid {
+				alreadyKnown = true
+				break
+			}
+		}
+		if !alreadyKnown {
+			s.gm.AddResourceTopology(&rtnd)
+			if rtnd.ParentId == "" {
+				s.resourceRoots[&rtnd] = struct{}{}
+			}
+		}
+		s.resourceRootsMu.Unlock()
+	}
+}
+
+// publishJob makes jd visible to every HA instance via the shared job
+// queue, so that even a non-leader's AddJob call is eventually solved for.
+func (s *scheduler) publishJob(jd *pb.JobDescriptor) {
+	if s.ha == nil {
+		return
+	}
+	value, err := json.Marshal(jd)
+	if err != nil {
+		log.Printf("flowscheduler: failed to marshal job %s: %v", jd.Uuid, err)
+		return
+	}
+	key := types.StateStoreKey{Prefix: jobQueueKeyPrefix, Name: jd.Uuid}
+	if err := s.ha.stateStore.Put(key, value); err != nil {
+		log.Printf("flowscheduler: failed to publish job %s: %v", jd.Uuid, err)
+	}
+}
+
+// watchJobQueue hydrates jobsToSchedule (or, for a SystemBatch job,
+// systemBatchJobs) from the shared job queue, so a job submitted to one
+// instance's AddJob is still seen by every other instance: the one actually
+// elected leader (for an ordinary job, which needs to reach the solver) and,
+// for a SystemBatch job, every instance (each fans it out across its own
+// feasiblePUs independently of leadership). Once an entry has been folded
+// into local state, its queue entry is cleared so it isn't re-hydrated on
+// every watch reconnect.
+func (s *scheduler) watchJobQueue() {
+	events, err := s.ha.stateStore.Watch(jobQueueKeyPrefix, s.ha.stopCh)
+	if err != nil {
+		log.Printf("flowscheduler: job-queue watch error: %v", err)
+		return
+	}
+	for ev := range events {
+		if ev.Deleted {
+			continue
+		}
+		var jd pb.JobDescriptor
+		if err := json.Unmarshal(ev.Value, &jd); err != nil {
+			log.Printf("flowscheduler: bad job-queue event for %s: %v", ev.Key.Name, err)
+			continue
+		}
+		jobID := util.MustJobIDFromString(jd.Uuid)
+
+		var known bool
+		if jd.Type == pb.JobDescriptor_SystemBatch {
+			s.systemBatchJobsMu.Lock()
+			_, known = s.systemBatchJobs[jobID]
+			s.systemBatchJobsMu.Unlock()
+			if !known {
+				s.addSystemBatchJob(&jd)
+			}
+		} else {
+			s.jobsMu.Lock()
+			_, known = s.jobsToSchedule[jobID]
+			if !known {
+				s.jobsToSchedule[jobID] = &jd
+			}
+			s.jobsMu.Unlock()
+		}
+		if known {
+			continue
+		}
+
+		key := types.StateStoreKey{Prefix: jobQueueKeyPrefix, Name: jd.Uuid}
+		if err := s.ha.stateStore.Delete(key); err != nil {
+			log.Printf("flowscheduler: failed to clear job-queue entry for %s: %v", jd.Uuid, err)
+		}
+	}
+}
+
+// publishResourceTopology makes rtnd visible to every HA instance via the
+// shared resource-topology prefix; see watchResourceTopology.
+func (s *scheduler) publishResourceTopology(rtnd *pb.ResourceTopologyNodeDescriptor) {
+	if s.ha == nil {
+		return
+	}
+	value, err := json.Marshal(rtnd)
+	if err != nil {
+		log.Printf("flowscheduler: failed to marshal resource topology %s: %v", rtnd.ResourceDesc.Uuid, err)
+		return
+	}
+	key := types.StateStoreKey{Prefix: resourceTopologyKeyPrefix, Name: rtnd.ResourceDesc.Uuid}
+	if err := s.ha.stateStore.Put(key, value); err != nil {
+		log.Printf("flowscheduler: failed to publish resource topology %s: %v", rtnd.ResourceDesc.Uuid, err)
+	}
+}
+
+// Close ends this instance's participation in HA, releasing its session
+// (and with it, leadership) immediately rather than waiting for the lease
+// to expire.
+func (s *scheduler) Close() error {
+	if s.ha == nil {
+		return nil
+	}
+	close(s.ha.stopCh)
+	return s.ha.session.Close()
+}
@@ -0,0 +1,191 @@
+package flowscheduler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/ksched/pkg/types"
+	"github.com/coreos/ksched/pkg/util"
+	pb "github.com/coreos/ksched/proto"
+)
+
+// ResourceOffer models a time-bounded grant of capacity, borrowed from the
+// Mesos/AliceO2 manager design, rather than a row in a persistent
+// resourceTopology snapshot. RegisterResource still exists, but is now a
+// thin wrapper that turns its topology into one long-lived offer.
+type ResourceOffer struct {
+	OfferID    string
+	ResourceID types.ResourceID
+	Descriptor *pb.ResourceDescriptor
+	TTL        time.Duration
+	issuedAt   time.Time
+}
+
+func (o *ResourceOffer) expired() bool {
+	if o.TTL <= 0 {
+		return false
+	}
+	return time.Since(o.issuedAt) > o.TTL
+}
+
+// ResourceOffersDeploymentRequest asks the offer subsystem to try to place
+// a batch of tasks against whatever offers are currently live. The result
+// is delivered asynchronously on OutcomeCh rather than returned, since the
+// request is handled on the offer-loop goroutine. Tasks that find no live
+// offer are reported as Undeployed; the request does not wait for more
+// offers to arrive.
+type ResourceOffersDeploymentRequest struct {
+	TasksToDeploy []*pb.TaskDescriptor
+	EnvID         string
+	OutcomeCh     chan ResourceOffersOutcome
+}
+
+// ResourceOffersOutcome is the result of a ResourceOffersDeploymentRequest:
+// which of the requested tasks could be deployed against a live offer and
+// which could not, plus an error if the request failed outright.
+type ResourceOffersOutcome struct {
+	Deployed   []*pb.TaskDescriptor
+	Undeployed []*pb.TaskDescriptor
+	Err        error
+}
+
+// offerBook is the scheduler's live offer set plus the queue of deployment
+// requests waiting on it. offers is written both by SubmitOffer (on the
+// caller's goroutine) and by the offerLoop goroutine (pickLiveOffer/
+// tryDeploy), so every access goes through mu.
+type offerBook struct {
+	mu       sync.Mutex
+	offers   map[string]*ResourceOffer
+	requests chan *ResourceOffersDeploymentRequest
+	reviveCh chan struct{}
+}
+
+// SubmitOffer adds offer to the live set. A background goroutine (started
+// the first time SubmitOffer, ReviveOffers, or RequestDeployment is called)
+// matches deployment requests against the live set as each request arrives;
+// the flow solver is not invoked for this.
+func (s *scheduler) SubmitOffer(offer *ResourceOffer) {
+	s.ensureOfferLoop()
+	s.offerBook.mu.Lock()
+	s.offerBook.offers[offer.OfferID] = offer
+	s.offerBook.mu.Unlock()
+}
+
+// ReviveOffers wakes the offer loop. No offer source is contacted, and the
+// loop takes no action on a revive by itself: requests are only evaluated
+// when RequestDeployment hands them in.
+func (s *scheduler) ReviveOffers() {
+	s.ensureOfferLoop()
+	select {
+	case s.offerBook.reviveCh <- struct{}{}:
+	default:
+		// A revive is already pending; no need to queue another.
+	}
+}
+
+// RequestDeployment enqueues req for the offer loop to try once against the
+// set of live offers at the time the loop picks it up; it is not retried
+// against later offers. The caller receives its outcome on req.OutcomeCh.
+func (s *scheduler) RequestDeployment(req *ResourceOffersDeploymentRequest) {
+	s.ensureOfferLoop()
+	s.offerBook.requests <- req
+}
+
+// ensureOfferLoop lazily creates offerBook/offerLoop. offerBookMu guards
+// the check-and-create so concurrent SubmitOffer/ReviveOffers/
+// RequestDeployment calls can't race each other into starting more than
+// one offerLoop goroutine.
+func (s *scheduler) ensureOfferLoop() {
+	s.offerBookMu.Lock()
+	defer s.offerBookMu.Unlock()
+	if s.offerBook != nil {
+		return
+	}
+	s.offerBook = &offerBook{
+		offers:   make(map[string]*ResourceOffer),
+		requests: make(chan *ResourceOffersDeploymentRequest, 64),
+		reviveCh: make(chan struct{}, 1),
+	}
+	go s.offerLoop()
+}
+
+// offerLoop is the async heart of the offer subsystem: it takes incoming
+// deployment requests one at a time, matches each against live
+// (non-expired) offers via tryDeploy, without the flow solver, and reports
+// the outcome back on each request's own channel.
+func (s *scheduler) offerLoop() {
+	for {
+		select {
+		case req, ok := <-s.offerBook.requests:
+			if !ok {
+				return
+			}
+			s.tryDeploy(req)
+		case <-s.offerBook.reviveCh:
+			// Nothing to do on its own; a revive just means the next
+			// SubmitOffer/RequestDeployment should be re-evaluated, which
+			// happens naturally as those calls come in.
+		}
+	}
+}
+
+// tryDeploy matches req's tasks against live offers one-for-one. Unlike
+// RunSchedulingIteration's global solve, this is a best-effort pass meant
+// for callers (external brokers) who need an answer per request rather
+// than per cluster-wide iteration.
+func (s *scheduler) tryDeploy(req *ResourceOffersDeploymentRequest) {
+	outcome := ResourceOffersOutcome{}
+	for _, td := range req.TasksToDeploy {
+		offer := s.pickLiveOffer()
+		if offer == nil {
+			outcome.Undeployed = append(outcome.Undeployed, td)
+			continue
+		}
+		taskID := types.TaskID(td.Uid)
+		s.taskBindingsMu.Lock()
+		s.taskBindings[taskID] = offer.ResourceID
+		s.taskBindingsMu.Unlock()
+		outcome.Deployed = append(outcome.Deployed, td)
+	}
+	if req.OutcomeCh != nil {
+		req.OutcomeCh <- outcome
+	}
+}
+
+// pickLiveOffer returns one non-expired offer, or nil if none remain. A
+// one-shot offer (TTL > 0, e.g. from an external resource manager) is popped
+// so it is never handed out twice; a long-lived, non-expiring offer (TTL <=
+// 0, notably the synthetic one registerResourceAsOffer creates for every
+// registered resource) is left in the book so the resource it represents
+// stays offerable after this deployment, rather than disappearing from the
+// pool the first time anything is scheduled against it.
+func (s *scheduler) pickLiveOffer() *ResourceOffer {
+	s.offerBook.mu.Lock()
+	defer s.offerBook.mu.Unlock()
+	for id, offer := range s.offerBook.offers {
+		if offer.expired() {
+			delete(s.offerBook.offers, id)
+			continue
+		}
+		if offer.TTL > 0 {
+			delete(s.offerBook.offers, id)
+		}
+		return offer
+	}
+	return nil
+}
+
+// registerResourceAsOffer turns rtnd's root resource into a synthetic,
+// non-expiring offer, so that the pre-existing RegisterResource call keeps
+// working for callers that still think in terms of a persistent topology.
+func (s *scheduler) registerResourceAsOffer(rtnd *pb.ResourceTopologyNodeDescriptor) {
+	resID := util.MustResourceIDFromString(rtnd.ResourceDesc.Uuid)
+	s.SubmitOffer(&ResourceOffer{
+		OfferID:    fmt.Sprintf("static/%s", rtnd.ResourceDesc.Uuid),
+		ResourceID: resID,
+		Descriptor: rtnd.ResourceDesc,
+		TTL:        0,
+		issuedAt:   time.Now(),
+	})
+}
@@ -2,6 +2,7 @@ package flowscheduler
 
 import (
 	"log"
+	"sync"
 
 	"github.com/coreos/ksched/pkg/types"
 	"github.com/coreos/ksched/pkg/util"
@@ -24,24 +25,97 @@ type scheduler struct {
 	// Flow scheduler specific fields
 	gm     flowmanager.GraphManager
 	solver placement.Solver
-	// Root nodes(presumably machines) of all the resources in the topology
-	resourceRoots map[*pb.ResourceTopologyNodeDescriptor]struct{}
+	// Root nodes(presumably machines) of all the resources in the topology.
+	// resourceRootsMu guards it: in HA mode it is written both by
+	// RegisterResource callers and by the topology watcher goroutine (see
+	// ha.go).
+	resourceRootsMu sync.Mutex
+	resourceRoots   map[*pb.ResourceTopologyNodeDescriptor]struct{}
 
 	// Event driven scheduler specific fields
 	// Note: taskBindings tracks the old state of which task maps to which resource (before each iteration).
-	taskBindings map[types.TaskID]types.ResourceID
+	// taskBindingsMu guards it: tryDeploy (offers.go) writes it from the
+	// offer-loop goroutine while RunSchedulingIteration reads/writes it from
+	// the scheduling-iteration goroutine.
+	taskBindingsMu sync.Mutex
+	taskBindings   map[types.TaskID]types.ResourceID
 	// A vector holding descriptors of the jobs to be scheduled in the next scheduling round.
+	// jobsMu guards jobsToSchedule: in HA mode it is written both by AddJob
+	// callers and by the job-queue watcher goroutine (see ha.go).
+	jobsMu         sync.Mutex
 	jobsToSchedule map[types.JobID]*pb.JobDescriptor
 	runnableTasks  map[types.JobID]TaskSet
 	// Sets of runnable and blocked tasks in each job.
 	// Originally maintained up by ComputeRunnableTasksForJob() and LazyGraphReduction()
 	// by checking and resolving dependencies between tasks. We will avoid that for now
 	// and simply declare all tasks as runnable
+
+	// In-flight pb.JobDescriptor_SystemBatch jobs, keyed by JobID. These are
+	// fanned out across every compatible PU instead of being handed to
+	// jobsToSchedule/the flow solver; see systembatch.go.
+	// systemBatchJobsMu guards it: AddJob and RegisterResource (via
+	// TriggerSystemBatchReconcile) can both reach it concurrently.
+	systemBatchJobsMu sync.Mutex
+	systemBatchJobs   map[types.JobID]*systemBatchJob
+
+	// ha is non-nil once EnableHA has been called, and holds the state that
+	// lets several scheduler instances cooperate against a shared
+	// types.StateStore; see ha.go.
+	ha *haState
+
+	// taskStateMachine gives race-safe accounting of every task's
+	// Created->Runnable->Assigned->Running->{Completed,Failed,Preempted,
+	// Migrating} lifecycle; see taskstatemachine.go.
+	taskStateMachine *TaskStateMachine
+	tasksLaunched    int
+	tasksFinished    int
+
+	// offerBook is non-nil once the offer subsystem has been used (see
+	// offers.go). RegisterResource always populates it, so a scheduler that
+	// only ever registers a static topology still gets a working offer
+	// subsystem behind the scenes. offerBookMu guards its lazy creation in
+	// ensureOfferLoop, which SubmitOffer/ReviveOffers/RequestDeployment can
+	// all call concurrently.
+	offerBookMu sync.Mutex
+	offerBook   *offerBook
+
+	// executor drives the actual PLACE/PREEMPT/MIGRATE/KILL side effects;
+	// see executor.go. tasksFailed counts deltas the executor could not
+	// apply; retryQueue holds them so RunSchedulingIteration re-attempts
+	// them on the next iteration instead of dropping them. There is no
+	// delay between attempts beyond the iteration interval itself.
+	// taskHandlesMu guards taskHandles: it is written from the scheduling-
+	// iteration goroutine (HandleTaskPlacement/HandleTaskEviction) and from
+	// the ackExecutorEvents goroutine started by SetExecutor.
+	executor      Executor
+	tasksFailed   int
+	retryQueue    []retryableDelta
+	taskHandlesMu sync.Mutex
+	taskHandles   map[types.TaskID]TaskHandle
+}
+
+// retryableDelta is a SchedulingDelta that failed to apply, plus the
+// attempts count that failDelta compares against maxDeltaRetries.
+type retryableDelta struct {
+	delta    pb.SchedulingDelta
+	attempts int
 }
 
 // Event scheduler method
 func (s *scheduler) AddJob(jd *pb.JobDescriptor) {
+	if jd.Type == pb.JobDescriptor_SystemBatch {
+		s.addSystemBatchJob(jd)
+		// System-batch jobs bypass jobsToSchedule, but still need to reach
+		// every other HA instance so they fan out cluster-wide rather than
+		// only on whichever instance happened to receive AddJob; see
+		// watchJobQueue's SystemBatch branch.
+		s.publishJob(jd)
+		return
+	}
+	s.jobsMu.Lock()
 	s.jobsToSchedule[util.MustJobIDFromString(jd.Uuid)] = jd
+	s.jobsMu.Unlock()
+	s.publishJob(jd)
 }
 
 // Not needed for testing
@@ -53,7 +127,9 @@ func (s *scheduler) HandleJobCompletion(jobID types.JobID) {
 	if jd == nil {
 		log.Panicf("Job for id:%v must exist\n", jobID)
 	}
+	s.jobsMu.Lock()
 	delete(s.jobsToSchedule, jobID)
+	s.jobsMu.Unlock()
 	delete(s.runnableTasks, jobID)
 	jd.State = pb.JobDescriptor_Completed
 }
@@ -73,8 +149,22 @@ func (s *scheduler) RegisterResource(rtnd *pb.ResourceTopologyNodeDescriptor) {
 	// Flow scheduler related work
 	s.gm.AddResourceTopology(rtnd)
 	if rtnd.ParentId == "" {
+		s.resourceRootsMu.Lock()
 		s.resourceRoots[rtnd] = struct{}{}
+		s.resourceRootsMu.Unlock()
 	}
+
+	// Newly registered PUs may be feasible targets for system-batch jobs
+	// that are already in flight, so re-run their fan-out.
+	s.TriggerSystemBatchReconcile()
+
+	// RegisterResource is now just sugar for advertising a static,
+	// non-expiring offer; see offers.go.
+	s.registerResourceAsOffer(rtnd)
+
+	// Tell every other HA instance about this resource so their
+	// resourceRoots/gm stay in sync; see ha.go.
+	s.publishResourceTopology(rtnd)
 }
 
 func (s *scheduler) RunSchedulingIteration() ([]pb.SchedulingDelta, int) {
@@ -87,7 +177,46 @@ func (s *scheduler) RunSchedulingIteration() ([]pb.SchedulingDelta, int) {
 	// - In original code, it also handles time dependent cost updating. Ignored here.
 	// - No purging of unconnected EC.
 
-	taskMappings := s.solver.Solve()
+	// In HA mode, only the elected leader runs the solve step; other
+	// instances keep accepting AddJob/RegisterResource (see publishJob and
+	// watchResourceTopology) so they're ready to take over instantly.
+	if !s.IsLeader() {
+		return nil, 0
+	}
+
+	// Reconcile the previous iteration's bindings against the current set of
+	// jobs/resources before going anywhere near the solver, so steady-state
+	// iterations only pay for what actually changed. jobsToSchedule is
+	// snapshotted under jobsMu since, in HA mode, the job-queue watcher
+	// goroutine (see ha.go) can be writing to it concurrently.
+	s.jobsMu.Lock()
+	jobsSnapshot := make(map[types.JobID]*pb.JobDescriptor, len(s.jobsToSchedule))
+	for jobID, jd := range s.jobsToSchedule {
+		jobsSnapshot[jobID] = jd
+	}
+	s.jobsMu.Unlock()
+
+	// taskBindings gets the same snapshot treatment: tryDeploy (offers.go)
+	// can be writing it from the offer-loop goroutine at any time.
+	s.taskBindingsMu.Lock()
+	taskBindingsSnapshot := make(map[types.TaskID]types.ResourceID, len(s.taskBindings))
+	for taskID, resID := range s.taskBindings {
+		taskBindingsSnapshot[taskID] = resID
+	}
+	s.taskBindingsMu.Unlock()
+	diff := computeDiff(taskBindingsSnapshot, jobsSnapshot, s.runnableTasks, s.taskMap, s.resourceMap)
+
+	// Only the place/update/migrate candidates are handed to the solver;
+	// ignore/lost/stop are resolved directly via deltasForDiff below, so
+	// the flow graph doesn't carry every runnable task every iteration.
+	//
+	// NOTE(upstream): this assumes placement.Solver.Solve takes a
+	// []types.TaskID of candidates; the copy of that package vendored into
+	// this tree still only defines the old no-argument Solve(). That
+	// signature change (and the proto/util/flowmanager additions this
+	// series relies on elsewhere - see systembatch.go) belongs in a
+	// corresponding upstream commit, not silently assumed here.
+	taskMappings := s.solver.Solve(diff.candidateTasks())
 
 	// We first generate the deltas for the preempted tasks in a separate step.
 	// Otherwise, we would have to maintain for every ResourceDescriptor the
@@ -95,23 +224,39 @@ func (s *scheduler) RunSchedulingIteration() ([]pb.SchedulingDelta, int) {
 	// RepeatedFields don't have any efficient remove element method.
 	deltas := s.gm.SchedulingDeltasForPreemptedTasks(taskMappings, s.resourceMap)
 
+	s.taskBindingsMu.Lock()
 	for taskNodeID, resourceNodeID := range taskMappings {
 		// Note: Ignore those completed, removal check...
 
 		d := s.gm.NodeBindingToSchedulingDelta(taskNodeID, resourceNodeID, s.taskBindings)
 		deltas = append(deltas, d)
 	}
+	s.taskBindingsMu.Unlock()
+
+	deltas = append(deltas, s.deltasForDiff(diff)...)
+	deltas = append(deltas, s.dueRetries()...)
 
 	numScheduled := s.ApplySchedulingDeltas(deltas)
 
 	// TODO: update_resource_topology_capacities??
+	s.resourceRootsMu.Lock()
 	for rtnd := range s.resourceRoots {
 		s.gm.UpdateResourceTopology(rtnd)
 	}
+	s.resourceRootsMu.Unlock()
+
+	// System-batch jobs are pinned at dispatch time rather than solved for,
+	// so completion is detected separately from the delta loop above.
+	s.systemBatchJobsCompleted()
 
 	return deltas, numScheduled
 }
 
+// maxDeltaRetries bounds how many times a failed delta is retried before
+// it is dropped for good (still counted in tasksFailed, but logged loudly
+// since it means a task is stuck).
+const maxDeltaRetries = 5
+
 func (s *scheduler) ApplySchedulingDeltas(deltas []pb.SchedulingDelta) int {
 	numScheduled := 0
 	for _, d := range deltas {
@@ -119,6 +264,29 @@ func (s *scheduler) ApplySchedulingDeltas(deltas []pb.SchedulingDelta) int {
 		if td == nil {
 			panic("")
 		}
+
+		// A PREEMPT delta for a lost task (computeDiff's "lost" bucket)
+		// carries no ResourceId: the resource it was bound to has already
+		// disappeared, so there is nothing to look up.
+		if d.Type == pb.SchedulingDelta_PREEMPT && d.ResourceId == "" {
+			if err := s.HandleTaskEviction(td, nil); err != nil {
+				s.failDelta(d, err)
+			}
+			continue
+		}
+
+		// KILL addresses job cancellation directly instead of piggybacking
+		// on PREEMPT, and doesn't need a resource lookup: the task may
+		// already have finished on its own.
+		if d.Type == pb.SchedulingDelta_KILL {
+			if err := s.killTask(types.TaskID(d.TaskId)); err != nil {
+				s.failDelta(d, err)
+				continue
+			}
+			numScheduled++
+			continue
+		}
+
 		resID := util.MustResourceIDFromString(d.ResourceId)
 		rs := s.resourceMap.FindPtrOrNull(resID)
 		if rs == nil {
@@ -131,12 +299,19 @@ func (s *scheduler) ApplySchedulingDeltas(deltas []pb.SchedulingDelta) int {
 			if jd.State != pb.JobDescriptor_Running {
 				jd.State = pb.JobDescriptor_Running
 			}
-			s.HandleTaskPlacement(td, rs.Descriptor())
+			if err := s.HandleTaskPlacement(td, rs.Descriptor()); err != nil {
+				s.failDelta(d, err)
+				continue
+			}
 			numScheduled++
 		case pb.SchedulingDelta_PREEMPT:
-			s.HandleTaskEviction(td, rs.Descriptor())
+			if err := s.HandleTaskEviction(td, rs.Descriptor()); err != nil {
+				s.failDelta(d, err)
+			}
 		case pb.SchedulingDelta_MIGRATE:
-			s.HandleTaskMigration(td, rs.Descriptor())
+			if err := s.HandleTaskMigration(td, rs.Descriptor()); err != nil {
+				s.failDelta(d, err)
+			}
 		case pb.SchedulingDelta_NOOP:
 			log.Println("NOOP Delta type:", d.Type)
 		default:
@@ -146,11 +321,136 @@ func (s *scheduler) ApplySchedulingDeltas(deltas []pb.SchedulingDelta) int {
 	return numScheduled
 }
 
-func (s *scheduler) HandleTaskPlacement(td *pb.TaskDescriptor, rd *pb.ResourceDescriptor) {
+// failDelta records a delta the executor could not apply: it counts toward
+// tasksFailed and, unless it has already been retried maxDeltaRetries
+// times, is queued for another attempt on a later iteration.
+func (s *scheduler) failDelta(d pb.SchedulingDelta, err error) {
+	s.tasksFailed++
+	for i, r := range s.retryQueue {
+		if r.delta.TaskId == d.TaskId && r.delta.Type == d.Type {
+			if r.attempts >= maxDeltaRetries {
+				log.Printf("flowscheduler: giving up on delta %v for task %v after %d attempts: %v", d.Type, d.TaskId, r.attempts, err)
+				s.retryQueue = append(s.retryQueue[:i], s.retryQueue[i+1:]...)
+				return
+			}
+			s.retryQueue[i].attempts++
+			return
+		}
+	}
+	log.Printf("flowscheduler: delta %v for task %v failed, will retry: %v", d.Type, d.TaskId, err)
+	s.retryQueue = append(s.retryQueue, retryableDelta{delta: d, attempts: 1})
+}
+
+// dueRetries pops every queued retry so the caller can fold them back into
+// the next iteration's delta batch. Unlike the backoff attempts counter,
+// there is no time-based gating here: a retry is due again as soon as
+// another scheduling iteration runs.
+func (s *scheduler) dueRetries() []pb.SchedulingDelta {
+	if len(s.retryQueue) == 0 {
+		return nil
+	}
+	deltas := make([]pb.SchedulingDelta, len(s.retryQueue))
+	for i, r := range s.retryQueue {
+		deltas[i] = r.delta
+	}
+	s.retryQueue = nil
+	return deltas
+}
+
+// HandleTaskPlacement drives td's state machine through to Running, walking
+// whatever intermediate Assigned step it hasn't already taken, and asks the
+// executor to actually launch the task. A task that is already bound to a
+// resource (e.g. a duplicate PLACE delta) is left alone.
+func (s *scheduler) HandleTaskPlacement(td *pb.TaskDescriptor, rd *pb.ResourceDescriptor) error {
+	taskID := types.TaskID(td.Uid)
+	s.taskHandlesMu.Lock()
+	_, launched := s.taskHandles[taskID]
+	s.taskHandlesMu.Unlock()
+	if launched {
+		return nil
+	}
+	for s.taskStateMachine.State(taskID) != TaskAssigned && s.taskStateMachine.alpha(taskID, EventAssigned) {
+		if _, err := s.taskStateMachine.Drive(taskID, EventAssigned); err != nil {
+			return err
+		}
+	}
+	handle, err := s.executor.Launch(td, rd)
+	if err != nil {
+		return err
+	}
+	if _, err := s.taskStateMachine.Drive(taskID, EventLaunched); err != nil {
+		return err
+	}
+	s.taskHandlesMu.Lock()
+	s.taskHandles[taskID] = handle
+	s.taskHandlesMu.Unlock()
+	td.State = pb.TaskDescriptor_Running
+	s.tasksLaunched++
+	return nil
+}
+
+// HandleTaskEviction drives td's state machine to Preempted and asks the
+// executor to kill it, e.g. because the flow solver reassigned it
+// elsewhere or its resource disappeared.
+func (s *scheduler) HandleTaskEviction(td *pb.TaskDescriptor, rd *pb.ResourceDescriptor) error {
+	taskID := types.TaskID(td.Uid)
+	s.taskHandlesMu.Lock()
+	_, ok := s.taskHandles[taskID]
+	s.taskHandlesMu.Unlock()
+	if ok {
+		if err := s.executor.Kill(taskID); err != nil {
+			return err
+		}
+		s.taskHandlesMu.Lock()
+		delete(s.taskHandles, taskID)
+		s.taskHandlesMu.Unlock()
+	}
+	if _, err := s.taskStateMachine.Drive(taskID, EventPreempted); err != nil {
+		return err
+	}
+	td.State = pb.TaskDescriptor_Failed
+	return nil
 }
 
-func (s *scheduler) HandleTaskEviction(td *pb.TaskDescriptor, rd *pb.ResourceDescriptor) {
+// killTask is the KILL delta's teardown path (computeDiff's "stop" bucket,
+// e.g. the task's job was cancelled): like HandleTaskEviction it forgets the
+// executor handle and asks the executor to stop the task, but drives
+// EventFailed instead of EventPreempted since a killed task isn't coming
+// back via a re-Assign. Without this, taskHandles/taskStateMachine kept
+// reporting the task as launched/Running forever, and HandleTaskPlacement's
+// already-launched guard would refuse to ever relaunch the same TaskID.
+func (s *scheduler) killTask(taskID types.TaskID) error {
+	s.taskHandlesMu.Lock()
+	_, launched := s.taskHandles[taskID]
+	s.taskHandlesMu.Unlock()
+	if launched {
+		if err := s.executor.Kill(taskID); err != nil {
+			return err
+		}
+		s.taskHandlesMu.Lock()
+		delete(s.taskHandles, taskID)
+		s.taskHandlesMu.Unlock()
+	}
+	if s.taskStateMachine.alpha(taskID, EventFailed) {
+		if _, err := s.taskStateMachine.Drive(taskID, EventFailed); err != nil {
+			return err
+		}
+	}
+	if td := s.taskMap.FindPtrOrNull(taskID); td != nil {
+		td.State = pb.TaskDescriptor_Failed
+	}
+	return nil
 }
 
-func (s *scheduler) HandleTaskMigration(td *pb.TaskDescriptor, rd *pb.ResourceDescriptor) {
+// HandleTaskMigration starts td's move to rd via the executor and drives
+// EventMigrationStarted. Nothing in this package drives the matching
+// EventMigrationDone: executor events only report finished or lost tasks,
+// so the task stays Migrating until it fails.
+func (s *scheduler) HandleTaskMigration(td *pb.TaskDescriptor, rd *pb.ResourceDescriptor) error {
+	taskID := types.TaskID(td.Uid)
+	if err := s.executor.Migrate(taskID, rd); err != nil {
+		return err
+	}
+	_, err := s.taskStateMachine.Drive(taskID, EventMigrationStarted)
+	return err
 }
@@ -0,0 +1,185 @@
+package flowscheduler
+
+import (
+	"log"
+
+	"github.com/coreos/ksched/pkg/types"
+	"github.com/coreos/ksched/pkg/util"
+	"github.com/coreos/ksched/pkg/util/queue"
+	pb "github.com/coreos/ksched/proto"
+)
+
+// NOTE(upstream): this file, and the rest of the chunk0 series built on top
+// of it, assumes several proto/util/flowmanager additions that no commit
+// here actually makes (none of those packages are vendored into this tree):
+// pb.JobDescriptor_SystemBatch, pb.ResourceDescriptor_Taint, rd.Taints,
+// jd.LabelSelectors/jd.Tolerations, pb.Label, pb.TaskDescriptor.PendingUpdate,
+// pb.SchedulingDelta_KILL, util.CloneTaskDescriptorTemplate, and
+// gm.PinTaskToResource. They need a corresponding upstream change before
+// this series can actually build; flagging here rather than silently
+// assuming they already exist.
+
+// systemBatchJob tracks the fan-out of a single pb.JobDescriptor_SystemBatch
+// job across every compatible PU in the resource topology, analogous to
+// Nomad's sysbatch/system scheduler class. Unlike ordinary jobs, its tasks
+// are never handed to the flow solver: each one is pinned to the PU it was
+// instantiated for and is only ever re-pinned by an explicit reconcile.
+type systemBatchJob struct {
+	jd *pb.JobDescriptor
+	// tasks holds one fanned-out TaskDescriptor per compatible PU, keyed by
+	// the resource it is pinned to.
+	tasks map[types.ResourceID]*pb.TaskDescriptor
+}
+
+// done reports whether every fan-out task of the job has reached a terminal
+// state (Completed or Failed).
+func (sbj *systemBatchJob) done() bool {
+	for _, td := range sbj.tasks {
+		if td.State != pb.TaskDescriptor_Completed && td.State != pb.TaskDescriptor_Failed {
+			return false
+		}
+	}
+	return true
+}
+
+// resourcePredicate reports whether rd is a feasible placement target for
+// the task template of a system-batch job. It is checked against every PU
+// reachable from resourceRoots.
+type resourcePredicate func(jd *pb.JobDescriptor, rd *pb.ResourceDescriptor) bool
+
+// defaultSystemBatchPredicate filters out PUs that are not schedulable, that
+// are tainted without a matching toleration on the job, or whose labels
+// don't satisfy the job's placement constraints.
+func defaultSystemBatchPredicate(jd *pb.JobDescriptor, rd *pb.ResourceDescriptor) bool {
+	if rd.Type != pb.ResourceDescriptor_ResourcePu || !rd.Schedulable {
+		return false
+	}
+	for _, taint := range rd.Taints {
+		if !jobTolerates(jd, taint) {
+			return false
+		}
+	}
+	for _, label := range jd.LabelSelectors {
+		if !hasLabel(rd.Labels, label) {
+			return false
+		}
+	}
+	return true
+}
+
+func jobTolerates(jd *pb.JobDescriptor, taint *pb.ResourceDescriptor_Taint) bool {
+	for _, t := range jd.Tolerations {
+		if t == taint.Key {
+			return true
+		}
+	}
+	return false
+}
+
+func hasLabel(labels []*pb.Label, want *pb.Label) bool {
+	for _, l := range labels {
+		if l.Key == want.Key && l.Value == want.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// feasiblePUs does a BFS over resourceRoots and returns every PU that
+// passes pred for jd.
+func (s *scheduler) feasiblePUs(jd *pb.JobDescriptor, pred resourcePredicate) []*pb.ResourceDescriptor {
+	var pus []*pb.ResourceDescriptor
+	toVisit := queue.NewFIFO()
+	s.resourceRootsMu.Lock()
+	for root := range s.resourceRoots {
+		toVisit.Push(root)
+	}
+	s.resourceRootsMu.Unlock()
+	for !toVisit.IsEmpty() {
+		rtnd := toVisit.Pop().(*pb.ResourceTopologyNodeDescriptor)
+		if pred(jd, rtnd.ResourceDesc) {
+			pus = append(pus, rtnd.ResourceDesc)
+		}
+		for _, child := range rtnd.Children {
+			toVisit.Push(child)
+		}
+	}
+	return pus
+}
+
+// addSystemBatchJob registers jd as a fan-out job and performs its initial
+// dispatch across every currently feasible PU.
+func (s *scheduler) addSystemBatchJob(jd *pb.JobDescriptor) {
+	jobID := util.MustJobIDFromString(jd.Uuid)
+	s.systemBatchJobsMu.Lock()
+	s.systemBatchJobs[jobID] = &systemBatchJob{
+		jd:    jd,
+		tasks: make(map[types.ResourceID]*pb.TaskDescriptor),
+	}
+	s.systemBatchJobsMu.Unlock()
+	s.reconcileSystemBatchJob(jobID)
+}
+
+// reconcileSystemBatchJob materializes one TaskDescriptor per feasible PU
+// that does not already have a fan-out task, and pins it in the flow graph
+// so the solver never reconsiders its placement. Operators (or a topology
+// watch) can call this again after the cluster changes shape to pick up new
+// PUs without disturbing tasks that are already running.
+func (s *scheduler) reconcileSystemBatchJob(jobID types.JobID) {
+	s.systemBatchJobsMu.Lock()
+	sbj, ok := s.systemBatchJobs[jobID]
+	s.systemBatchJobsMu.Unlock()
+	if !ok {
+		log.Panicf("system-batch job for id:%v must exist\n", jobID)
+	}
+	for _, rd := range s.feasiblePUs(sbj.jd, defaultSystemBatchPredicate) {
+		resID := util.MustResourceIDFromString(rd.Uuid)
+		s.systemBatchJobsMu.Lock()
+		_, ok := sbj.tasks[resID]
+		s.systemBatchJobsMu.Unlock()
+		if ok {
+			continue
+		}
+		td := util.CloneTaskDescriptorTemplate(sbj.jd)
+		td.State = pb.TaskDescriptor_Runnable
+		s.taskMap.InsertOrUpdate(types.TaskID(td.Uid), td)
+		s.systemBatchJobsMu.Lock()
+		sbj.tasks[resID] = td
+		s.systemBatchJobsMu.Unlock()
+		s.gm.PinTaskToResource(types.TaskID(td.Uid), resID)
+	}
+}
+
+// TriggerSystemBatchReconcile re-runs the fan-out for every in-flight
+// system-batch job. It is meant to be called whenever the topology changes
+// (new resources registering, or a periodic operator-driven sweep), so that
+// newly available PUs pick up a copy of the job.
+func (s *scheduler) TriggerSystemBatchReconcile() {
+	s.systemBatchJobsMu.Lock()
+	jobIDs := make([]types.JobID, 0, len(s.systemBatchJobs))
+	for jobID := range s.systemBatchJobs {
+		jobIDs = append(jobIDs, jobID)
+	}
+	s.systemBatchJobsMu.Unlock()
+	for _, jobID := range jobIDs {
+		s.reconcileSystemBatchJob(jobID)
+	}
+}
+
+// systemBatchJobsCompleted scans in-flight fan-out jobs and runs the normal
+// HandleJobCompletion path for any whose tasks have all reached a terminal
+// state.
+func (s *scheduler) systemBatchJobsCompleted() {
+	s.systemBatchJobsMu.Lock()
+	done := make([]types.JobID, 0)
+	for jobID, sbj := range s.systemBatchJobs {
+		if sbj.done() {
+			done = append(done, jobID)
+			delete(s.systemBatchJobs, jobID)
+		}
+	}
+	s.systemBatchJobsMu.Unlock()
+	for _, jobID := range done {
+		s.HandleJobCompletion(jobID)
+	}
+}
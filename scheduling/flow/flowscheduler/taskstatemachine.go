@@ -0,0 +1,188 @@
+package flowscheduler
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/coreos/ksched/pkg/types"
+)
+
+// TaskState is a node in the task lifecycle state machine. The progression
+// mirrors GHC's capability/thread-pool machines and Tokio's task-core state
+// transitions: a task moves forward through Created/Runnable/Assigned/
+// Running, and from Running can fan out into any of several terminal or
+// semi-terminal states.
+type TaskState int
+
+const (
+	TaskCreated TaskState = iota
+	TaskRunnable
+	TaskAssigned
+	TaskRunning
+	TaskCompleted
+	TaskFailed
+	TaskPreempted
+	TaskMigrating
+)
+
+func (ts TaskState) String() string {
+	switch ts {
+	case TaskCreated:
+		return "Created"
+	case TaskRunnable:
+		return "Runnable"
+	case TaskAssigned:
+		return "Assigned"
+	case TaskRunning:
+		return "Running"
+	case TaskCompleted:
+		return "Completed"
+	case TaskFailed:
+		return "Failed"
+	case TaskPreempted:
+		return "Preempted"
+	case TaskMigrating:
+		return "Migrating"
+	default:
+		return "Unknown"
+	}
+}
+
+// TaskEvent drives a transition in the TaskStateMachine. A PLACE delta
+// applied by ApplySchedulingDeltas drives up to three events (the Assigned
+// steps the task has not yet taken, then Launched); PREEMPT and MIGRATE
+// deltas drive one, and a KILL delta at most one.
+type TaskEvent int
+
+const (
+	EventAssigned TaskEvent = iota
+	EventLaunched
+	EventCompleted
+	EventFailed
+	EventPreempted
+	EventMigrationStarted
+	EventMigrationDone
+)
+
+// EventListener is notified of every legal state transition. Consumers
+// such as dashboards or executor plugins subscribe via
+// TaskStateMachine.Subscribe instead of polling TaskMap.
+type EventListener interface {
+	OnTransition(taskID types.TaskID, from, to TaskState, event TaskEvent)
+}
+
+// transitions enumerates every legal (from-state, event) -> to-state move.
+// Anything not listed here is rejected by delta, e.g. Preempted->Running
+// without an intervening re-Assign.
+var transitions = map[TaskState]map[TaskEvent]TaskState{
+	TaskCreated: {
+		EventAssigned: TaskRunnable,
+	},
+	TaskRunnable: {
+		EventAssigned: TaskAssigned,
+	},
+	TaskAssigned: {
+		EventLaunched:  TaskRunning,
+		EventPreempted: TaskPreempted,
+		EventFailed:    TaskFailed,
+	},
+	TaskRunning: {
+		EventCompleted:        TaskCompleted,
+		EventFailed:           TaskFailed,
+		EventPreempted:        TaskPreempted,
+		EventMigrationStarted: TaskMigrating,
+	},
+	TaskMigrating: {
+		EventMigrationDone: TaskAssigned,
+		EventFailed:        TaskFailed,
+	},
+	TaskPreempted: {
+		EventAssigned: TaskAssigned,
+	},
+}
+
+// ErrIllegalTransition is returned by delta when the state machine has no
+// arc for (state, event).
+type ErrIllegalTransition struct {
+	From  TaskState
+	Event TaskEvent
+}
+
+func (e ErrIllegalTransition) Error() string {
+	return fmt.Sprintf("flowscheduler: no transition for event %d from state %s", e.Event, e.From)
+}
+
+// TaskStateMachine gives the scheduler race-safe, explicit accounting of
+// every task's lifecycle, replacing the implicit conventions that used to
+// live in HandleTaskPlacement/HandleTaskEviction/HandleTaskMigration. Its
+// storage is guarded the same way TaskMap is: a dedicated RWMutex around a
+// plain map, rather than relying on the caller to serialize access.
+type TaskStateMachine struct {
+	mu        sync.RWMutex
+	states    map[types.TaskID]TaskState
+	listeners []EventListener
+}
+
+// NewTaskStateMachine returns an empty TaskStateMachine; tasks default to
+// TaskCreated the first time an event is driven for them.
+func NewTaskStateMachine() *TaskStateMachine {
+	return &TaskStateMachine{states: make(map[types.TaskID]TaskState)}
+}
+
+// Subscribe registers l to be called synchronously on every transition this
+// machine drives from now on.
+func (tsm *TaskStateMachine) Subscribe(l EventListener) {
+	tsm.mu.Lock()
+	defer tsm.mu.Unlock()
+	tsm.listeners = append(tsm.listeners, l)
+}
+
+// State returns taskID's current state, defaulting to TaskCreated for a
+// task the machine has never seen.
+func (tsm *TaskStateMachine) State(taskID types.TaskID) TaskState {
+	tsm.mu.RLock()
+	defer tsm.mu.RUnlock()
+	return tsm.states[taskID]
+}
+
+// alpha reports whether event is relevant to taskID's current state at
+// all, letting callers cheaply skip events the machine doesn't track
+// (e.g. a second Launched for an already-Running task) without treating
+// them as errors.
+func (tsm *TaskStateMachine) alpha(taskID types.TaskID, event TaskEvent) bool {
+	tsm.mu.RLock()
+	defer tsm.mu.RUnlock()
+	_, ok := transitions[tsm.states[taskID]][event]
+	return ok
+}
+
+// delta performs the transition for (taskID, event), rejecting illegal
+// moves instead of silently leaving the task in an inconsistent state.
+// It performs exactly one transition per call.
+func (tsm *TaskStateMachine) delta(taskID types.TaskID, event TaskEvent) (TaskState, error) {
+	tsm.mu.Lock()
+	from := tsm.states[taskID]
+	to, ok := transitions[from][event]
+	if !ok {
+		tsm.mu.Unlock()
+		return from, ErrIllegalTransition{From: from, Event: event}
+	}
+	tsm.states[taskID] = to
+	listeners := tsm.listeners
+	tsm.mu.Unlock()
+
+	for _, l := range listeners {
+		l.OnTransition(taskID, from, to, event)
+	}
+	return to, nil
+}
+
+// Drive is the entry point the scheduler uses to advance taskID's state in
+// response to event. It is a thin wrapper over alpha/delta: alpha decides
+// whether the event is relevant, delta performs (and validates) the move.
+func (tsm *TaskStateMachine) Drive(taskID types.TaskID, event TaskEvent) (TaskState, error) {
+	if !tsm.alpha(taskID, event) {
+		return tsm.State(taskID), ErrIllegalTransition{From: tsm.State(taskID), Event: event}
+	}
+	return tsm.delta(taskID, event)
+}
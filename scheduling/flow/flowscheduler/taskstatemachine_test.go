@@ -0,0 +1,83 @@
+package flowscheduler
+
+import (
+	"testing"
+
+	"github.com/coreos/ksched/pkg/types"
+)
+
+func TestTaskStateMachineLegalSequence(t *testing.T) {
+	tsm := NewTaskStateMachine()
+	taskID := types.TaskID(1)
+
+	steps := []struct {
+		event TaskEvent
+		want  TaskState
+	}{
+		{EventAssigned, TaskRunnable},
+		{EventAssigned, TaskAssigned},
+		{EventLaunched, TaskRunning},
+		{EventCompleted, TaskCompleted},
+	}
+	for _, step := range steps {
+		got, err := tsm.Drive(taskID, step.event)
+		if err != nil {
+			t.Fatalf("Drive(%v) returned unexpected error: %v", step.event, err)
+		}
+		if got != step.want {
+			t.Fatalf("Drive(%v) = %v, want %v", step.event, got, step.want)
+		}
+	}
+	if got := tsm.State(taskID); got != TaskCompleted {
+		t.Fatalf("State() = %v, want %v", got, TaskCompleted)
+	}
+}
+
+func TestTaskStateMachineIllegalTransition(t *testing.T) {
+	tsm := NewTaskStateMachine()
+	taskID := types.TaskID(2)
+
+	// Drive taskID to Preempted (Created -> Runnable -> Assigned -> Preempted).
+	for _, ev := range []TaskEvent{EventAssigned, EventAssigned, EventPreempted} {
+		if _, err := tsm.Drive(taskID, ev); err != nil {
+			t.Fatalf("Drive(%v) returned unexpected error: %v", ev, err)
+		}
+	}
+
+	// Preempted has no arc for EventLaunched: there is no way to go straight
+	// to Running without an intervening re-Assign.
+	if _, err := tsm.Drive(taskID, EventLaunched); err == nil {
+		t.Fatal("Drive(EventLaunched) from Preempted: expected ErrIllegalTransition, got nil")
+	} else if _, ok := err.(ErrIllegalTransition); !ok {
+		t.Fatalf("Drive(EventLaunched) from Preempted: got %T, want ErrIllegalTransition", err)
+	}
+
+	// The illegal attempt must not have moved the task off Preempted.
+	if got := tsm.State(taskID); got != TaskPreempted {
+		t.Fatalf("State() after rejected transition = %v, want %v", got, TaskPreempted)
+	}
+}
+
+func TestTaskStateMachineSubscribe(t *testing.T) {
+	tsm := NewTaskStateMachine()
+	taskID := types.TaskID(3)
+
+	var got []TaskEvent
+	tsm.Subscribe(recorderListener(func(_ types.TaskID, from, to TaskState, event TaskEvent) {
+		got = append(got, event)
+	}))
+
+	if _, err := tsm.Drive(taskID, EventAssigned); err != nil {
+		t.Fatalf("Drive returned unexpected error: %v", err)
+	}
+	if len(got) != 1 || got[0] != EventAssigned {
+		t.Fatalf("listener recorded %v, want [EventAssigned]", got)
+	}
+}
+
+// recorderListener adapts a plain func to the EventListener interface.
+type recorderListener func(taskID types.TaskID, from, to TaskState, event TaskEvent)
+
+func (r recorderListener) OnTransition(taskID types.TaskID, from, to TaskState, event TaskEvent) {
+	r(taskID, from, to, event)
+}